@@ -0,0 +1,64 @@
+// This file is part of Mirrorlist.
+// Copyright (C) 2024 Enindu Alahapperuma
+//
+// Mirrorlist is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// Mirrorlist is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// Mirrorlist. If not, see <https://www.gnu.org/licenses/>.
+
+// Package pool runs a bounded number of HTTP worker goroutines over a list
+// of jobs, so that probing many mirrors does not open one connection per
+// mirror at once.
+package pool
+
+import (
+	"net/http"
+	"sync"
+)
+
+// Run executes work over jobs using concurrency worker goroutines, each
+// with its own *http.Client created by newClient. work reports ok as false
+// when a job produced no usable result, in which case it is dropped.
+func Run[J any, R any](jobs []J, concurrency int, newClient func() *http.Client, work func(job J, client *http.Client) (result R, ok bool)) []R {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	queue := make(chan J, len(jobs))
+	for _, v := range jobs {
+		queue <- v
+	}
+	close(queue)
+
+	results := make(chan R, len(jobs))
+	wait := &sync.WaitGroup{}
+	wait.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wait.Done()
+			client := newClient()
+			for job := range queue {
+				result, ok := work(job, client)
+				if !ok {
+					continue
+				}
+				results <- result
+			}
+		}()
+	}
+	wait.Wait()
+	close(results)
+
+	out := []R{}
+	for v := range results {
+		out = append(out, v)
+	}
+	return out
+}
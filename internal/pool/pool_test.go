@@ -0,0 +1,100 @@
+// This file is part of Mirrorlist.
+// Copyright (C) 2024 Enindu Alahapperuma
+//
+// Mirrorlist is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// Mirrorlist is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// Mirrorlist. If not, see <https://www.gnu.org/licenses/>.
+
+package pool
+
+import (
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"testing"
+)
+
+func newTestClient() *http.Client {
+	return &http.Client{}
+}
+
+func TestRunProcessesAllJobs(t *testing.T) {
+	jobs := []int{1, 2, 3, 4, 5}
+	results := Run(jobs, 2, newTestClient, func(job int, client *http.Client) (int, bool) {
+		return job * 2, true
+	})
+
+	sort.Ints(results)
+	want := []int{2, 4, 6, 8, 10}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, v := range results {
+		if v != want[i] {
+			t.Errorf("result %d: got %d, want %d", i, v, want[i])
+		}
+	}
+}
+
+func TestRunDropsFalseResults(t *testing.T) {
+	jobs := []int{1, 2, 3, 4, 5, 6}
+	results := Run(jobs, 3, newTestClient, func(job int, client *http.Client) (int, bool) {
+		return job, job%2 == 0
+	})
+
+	sort.Ints(results)
+	want := []int{2, 4, 6}
+	if len(results) != len(want) {
+		t.Fatalf("got %d results, want %d", len(results), len(want))
+	}
+	for i, v := range results {
+		if v != want[i] {
+			t.Errorf("result %d: got %d, want %d", i, v, want[i])
+		}
+	}
+}
+
+func TestRunGivesEachWorkerItsOwnClient(t *testing.T) {
+	var created int64
+	newClient := func() *http.Client {
+		atomic.AddInt64(&created, 1)
+		return &http.Client{}
+	}
+
+	jobs := make([]int, 50)
+	Run(jobs, 5, newClient, func(job int, client *http.Client) (int, bool) {
+		return job, true
+	})
+
+	if created != 5 {
+		t.Errorf("got %d clients created, want 5 (one per worker)", created)
+	}
+}
+
+func TestRunClampsNonPositiveConcurrency(t *testing.T) {
+	jobs := []int{1, 2, 3}
+	results := Run(jobs, 0, newTestClient, func(job int, client *http.Client) (int, bool) {
+		return job, true
+	})
+	if len(results) != len(jobs) {
+		t.Fatalf("got %d results, want %d", len(results), len(jobs))
+	}
+}
+
+func TestRunEmptyJobs(t *testing.T) {
+	results := Run([]int{}, 4, newTestClient, func(job int, client *http.Client) (int, bool) {
+		t.Fatal("work should not be called for an empty job list")
+		return job, true
+	})
+	if len(results) != 0 {
+		t.Fatalf("got %d results, want 0", len(results))
+	}
+}
@@ -31,42 +31,104 @@
 //	-https-only
 //		Use only HTTPS mirrors to generate mirror list. This can not use with
 //		-http-only flag.
+//	-source
+//		Mirror list source to use, either "json" for the Arch mirror status
+//		JSON API or "scrape" for the plain text mirror list. Defaults to
+//		"scrape" to match prior versions of mirrorlist.
+//	-countries
+//		Comma-separated ISO country codes to restrict mirrors to. Requires
+//		-source=json.
+//	-max-age
+//		Maximum hours since a mirror's last successful sync. Requires
+//		-source=json.
+//	-max-delay
+//		Maximum seconds a mirror is allowed to be behind master. Requires
+//		-source=json.
+//	-min-completion
+//		Minimum sync completion percentage, from 0 to 1. Requires
+//		-source=json.
+//	-max-score
+//		Maximum Arch mirror status score. Lower scores are better. Requires
+//		-source=json.
+//	-ipv4
+//		Only use mirrors that support IPv4. Requires -source=json.
+//	-ipv6
+//		Only use mirrors that support IPv6. Requires -source=json.
+//	-sort
+//		Sort mirrors by "rate", "score", "age", "delay", or "country".
+//		"rate" ranks by download throughput when -rate is set, and by
+//		request latency otherwise.
+//	-concurrency
+//		Number of mirrors to probe at the same time.
+//	-rate
+//		Rank mirrors by download throughput instead of request latency.
+//	-rate-bytes
+//		Maximum bytes to read per rate test request.
+//	-rate-url-path
+//		Path appended to a mirror's link to download the rate test file from.
+//	-cache-dir
+//		Directory to cache the fetched mirror list in. Defaults to
+//		$XDG_CACHE_HOME/mirrorlist.
+//	-cache-ttl
+//		How long a cached mirror list stays valid. 0 disables the cache.
 //	-count
 //		Count of mirrors to generate.
 //	-pings
 //		Pings per a mirror. Higher pings means precise results, but high
 //		execution time.
 //	-output
-//		Store mirrors in a file. This truncate any existing file.
+//		Store mirrors in a file. This is written atomically and truncates
+//		any existing file.
+//	-backup
+//		Back up the existing -output file to <output>.bak before replacing
+//		it.
+//	-check
+//		Only print the ranked mirrors to stdout, without touching -output.
+//	-merge
+//		Preserve manually pinned Server lines from the existing -output
+//		file.
 //	-verbose
 //		Display warning messages in command line.
 //
+// Mirrorlist listens for SIGINT and SIGTERM while probing mirrors. On
+// signal, in-flight requests are cancelled and whatever mirrors have
+// already been probed are used, provided at least -count of them
+// succeeded.
+//
 // [pacman]: https://wiki.archlinux.org/index.php/Pacman
 package main
 
 import (
 	"bufio"
+	"bytes"
 	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"slices"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
 
+	"github.com/enindu/mirrorlist/internal/pool"
 	"github.com/enindu/palette"
 )
 
 const (
-	allLink   string = "https://archlinux.org/mirrorlist/all"
-	httpLink  string = "https://archlinux.org/mirrorlist/all/http"
-	httpsLink string = "https://archlinux.org/mirrorlist/all/https"
+	allLink    string = "https://archlinux.org/mirrorlist/all"
+	httpLink   string = "https://archlinux.org/mirrorlist/all/http"
+	httpsLink  string = "https://archlinux.org/mirrorlist/all/https"
+	statusLink string = "https://archlinux.org/mirrors/status/json/"
 )
 
-var wait *sync.WaitGroup = &sync.WaitGroup{}
-
 var (
 	info *palette.Printer = palette.NewPrinterInfo()
 	warn *palette.Printer = palette.NewPrinterWarn()
@@ -78,31 +140,94 @@ var (
 	mirrorTimeout     *time.Duration = flag.Duration("mirror-timeout", 5*time.Second, "Request timeout to send and receive response from mirror URL.")
 	httpOnly          *bool          = flag.Bool("http-only", false, "Use only HTTP mirrors to generate mirror list. This can not use with -https-only flag.")
 	httpsOnly         *bool          = flag.Bool("https-only", false, "Use only HTTPS mirrors to generate mirror list. This can not use with -http-only flag.")
+	source            *string        = flag.String("source", "scrape", `Mirror list source to use, either "json" or "scrape". Defaults to "scrape" to match prior versions; pass -source=json to get the richer metadata and filters.`)
+	countries         *string        = flag.String("countries", "", "Comma-separated ISO country codes to restrict mirrors to. Requires -source=json.")
+	maxAge            *float64       = flag.Float64("max-age", 0, "Maximum hours since a mirror's last successful sync. 0 disables this filter. Requires -source=json.")
+	maxDelay          *int           = flag.Int("max-delay", 0, "Maximum seconds a mirror is allowed to be behind master. 0 disables this filter. Requires -source=json.")
+	minCompletion     *float64       = flag.Float64("min-completion", 0, "Minimum sync completion percentage, from 0 to 1. Requires -source=json.")
+	maxScore          *float64       = flag.Float64("max-score", 0, "Maximum Arch mirror status score. 0 disables this filter. Requires -source=json.")
+	ipv4Only          *bool          = flag.Bool("ipv4", false, "Only use mirrors that support IPv4. Requires -source=json.")
+	ipv6Only          *bool          = flag.Bool("ipv6", false, "Only use mirrors that support IPv6. Requires -source=json.")
+	sort              *string        = flag.String("sort", "rate", `Sort mirrors by "rate", "score", "age", "delay", or "country". "rate" ranks by throughput with -rate, and by latency otherwise.`)
+	concurrency       *int           = flag.Int("concurrency", 20, "Number of mirrors to probe at the same time.")
+	rate              *bool          = flag.Bool("rate", false, "Rank mirrors by download throughput instead of request latency.")
+	rateBytes         *int64         = flag.Int64("rate-bytes", 1<<20, "Maximum bytes to read per rate test request.")
+	rateURLPath       *string        = flag.String("rate-url-path", "core/os/x86_64/core.db", "Path appended to a mirror's link to download the rate test file from.")
+	cacheDir          *string        = flag.String("cache-dir", "", "Directory to cache the fetched mirror list in. Defaults to $XDG_CACHE_HOME/mirrorlist.")
+	cacheTTL          *time.Duration = flag.Duration("cache-ttl", 5*time.Minute, "How long a cached mirror list stays valid. 0 disables the cache.")
 	count             *int           = flag.Int("count", 5, "Count of mirrors to generate.")
 	pings             *int           = flag.Int("pings", 5, "Pings per a mirror. Higher pings means precise results, but high execution time.")
-	output            *string        = flag.String("output", "", "Store mirrors in a file. This truncate any existing file.")
+	output            *string        = flag.String("output", "", "Store mirrors in a file. This is written atomically and truncates any existing file.")
+	backup            *bool          = flag.Bool("backup", false, "Back up the existing -output file to <output>.bak before replacing it.")
+	check             *bool          = flag.Bool("check", false, "Only print the ranked mirrors to stdout, without touching -output.")
+	merge             *bool          = flag.Bool("merge", false, "Preserve manually pinned Server lines from the existing -output file.")
 	verbose           *bool          = flag.Bool("verbose", false, "Display warning messages in command line.")
 )
 
+// mirror holds a candidate mirror link along with the metadata collected
+// about it, either from the Arch mirror status JSON API or from probing it
+// directly.
+type mirror struct {
+	link          string
+	time          float64
+	rate          float64
+	score         float64
+	completionPct float64
+	delay         int
+	lastSync      time.Time
+	countryCode   string
+	ipv4          bool
+	ipv6          bool
+	protocol      string
+}
+
+// statusResponse is the shape of the response returned by statusLink.
+type statusResponse struct {
+	URLs []statusMirror `json:"urls"`
+}
+
+// statusMirror is a single mirror entry inside statusResponse.
+type statusMirror struct {
+	URL           string  `json:"url"`
+	Protocol      string  `json:"protocol"`
+	LastSync      *string `json:"last_sync"`
+	CompletionPct float64 `json:"completion_pct"`
+	Delay         int     `json:"delay"`
+	Score         float64 `json:"score"`
+	Active        bool    `json:"active"`
+	CountryCode   string  `json:"country_code"`
+	IPv4          bool    `json:"ipv4"`
+	IPv6          bool    `json:"ipv6"`
+}
+
 func main() {
 	// Parse flags.
 	flag.Parse()
 
+	// Cancel in-flight requests on SIGINT or SIGTERM.
+	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer cancel()
+
 	// Check if both -http-only and https-only flags used.
 	if *httpOnly && *httpsOnly {
 		erro.Print("can not use both -http-only and -https-only flags\n")
 		return
 	}
 
-	// Create mirror list link.
-	link := ""
-	switch {
-	case *httpOnly:
-		link = httpLink
-	case *httpsOnly:
-		link = httpsLink
+	// Check if -sort flag has a valid value.
+	switch *sort {
+	case "rate", "score", "age", "delay", "country":
 	default:
-		link = allLink
+		erro.Print("%s is not a valid -sort value\n", *sort)
+		return
+	}
+
+	// Check if a JSON-only metadata filter is used with -source=scrape,
+	// where every mirror would have zero-value metadata, so the filter
+	// would silently drop every mirror or have no effect at all.
+	if *source == "scrape" && metadataFiltersUsed() {
+		erro.Print("-countries, -max-age, -max-delay, -min-completion, -max-score, -ipv4, and -ipv6 require -source=json\n")
+		return
 	}
 
 	// Create mirror list HTTP client.
@@ -110,119 +235,477 @@ func main() {
 		Timeout: *mirrorListTimeout,
 	}
 
-	// Get response from mirror list link.
-	response, err := client.Get(link)
-	if err != nil {
-		erro.Print("could not get response from %s\n", link)
+	// Fetch candidate mirrors from the requested source.
+	var candidates []mirror
+	switch *source {
+	case "json":
+		var err error
+		candidates, err = fetchStatusMirrors(ctx, statusLink, client)
+		if err != nil {
+			erro.Print("could not get mirrors from %s\n", statusLink)
+			return
+		}
+		candidates = filterByProtocol(candidates)
+	case "scrape":
+		link := allLink
+		switch {
+		case *httpOnly:
+			link = httpLink
+		case *httpsOnly:
+			link = httpsLink
+		}
+		links, err := fetchScrapeLinks(ctx, link, client)
+		if err != nil {
+			erro.Print("could not get response from %s\n", link)
+			return
+		}
+		for _, v := range links {
+			candidates = append(candidates, mirror{link: v})
+		}
+	default:
+		erro.Print("%s is not a valid -source value\n", *source)
 		return
 	}
-	defer response.Body.Close()
 
-	// Create mirror links.
+	// Apply metadata filters.
+	candidates = filterMirrors(candidates)
+
+	// Define execution beginning time.
+	begin := time.Now()
+
+	// Ping mirror links using a bounded pool of workers.
+	mirrors := pool.Run(candidates, *concurrency, func() *http.Client {
+		return &http.Client{Timeout: *mirrorTimeout}
+	}, func(job mirror, c *http.Client) (mirror, bool) {
+		return ping(ctx, job, c)
+	})
+
+	// Define execution ending time.
+	end := time.Since(begin).Seconds()
+
+	// Check if mirrors count less than requested count.
+	interrupted := ctx.Err() != nil
+	if len(mirrors) < *count {
+		if interrupted {
+			erro.Print("interrupted after %.2fs with only %d mirror(s)\n", end, len(mirrors))
+		} else {
+			erro.Print("could not get %d mirror(s)\n", *count)
+		}
+		return
+	}
+
+	// Sort mirrors.
+	slices.SortFunc(mirrors, sortFunc(*sort))
+
+	// Render output.
+	var pinned []string
+	if *merge && *output != "" {
+		pinned = readPinnedServerLines(*output)
+	}
+	body := renderMirrorList(pinned, mirrors[:*count])
+	if interrupted {
+		body = append([]byte(fmt.Sprintf("# partial: interrupted after %.2fs\n", end)), body...)
+	}
+
+	// Write output.
+	if *check || *output == "" {
+		os.Stdout.Write(body)
+	} else if err := writeMirrorList(*output, body); err != nil {
+		erro.Print("could not write %s\n", *output)
+		return
+	}
+
+	// Print information messages.
+	if interrupted {
+		info.Print("mirror list is generated with partial results\n")
+	} else {
+		info.Print("mirror list is generated\n")
+	}
+	info.Print("executed in %.2f seconds\n", end)
+}
+
+// renderMirrorList builds the generated mirror list, with any pinned
+// Server lines kept above the generated block.
+func renderMirrorList(pinned []string, mirrors []mirror) []byte {
+	buffer := &bytes.Buffer{}
+	for _, v := range pinned {
+		fmt.Fprintf(buffer, "%s\n", v)
+	}
+	fmt.Fprintf(buffer, "%s\n", generatedMarker)
+	for _, v := range mirrors {
+		if v.countryCode != "" {
+			fmt.Fprintf(buffer, "# country: %s\n", v.countryCode)
+		}
+		if !v.lastSync.IsZero() {
+			fmt.Fprintf(buffer, "# score: %.2f, completion: %.2f, delay: %ds, last sync: %s\n", v.score, v.completionPct, v.delay, v.lastSync.Format(time.RFC3339))
+		}
+		if v.rate > 0 {
+			fmt.Fprintf(buffer, "# rate: %.2f KiB/s\n", v.rate)
+		}
+		fmt.Fprintf(buffer, "# %f\n", v.time)
+		fmt.Fprintf(buffer, "Server = %s/$repo/os/$arch\n", v.link)
+	}
+	return buffer.Bytes()
+}
+
+// generatedMarker delimits the generated block written by renderMirrorList.
+const generatedMarker = "# Generated by github.com/enindu/mirrorlist"
+
+// readPinnedServerLines returns the manually uncommented Server lines
+// found above the generated block of the existing file at path, so -merge
+// can keep them.
+//
+// Before -merge existed, the marker was written as the last line of the
+// file instead of the first, with every Server line above it generated
+// rather than pinned. Those files are detected and treated as having
+// nothing pinned, so a first -merge run replaces them instead of freezing
+// their old mirror list in place forever.
+func readPinnedServerLines(path string) []string {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == generatedMarker {
+		return nil
+	}
+
+	pinned := []string{}
+	for _, line := range lines {
+		if line == generatedMarker {
+			break
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), "Server") {
+			pinned = append(pinned, line)
+		}
+	}
+	return pinned
+}
+
+// writeMirrorList writes body to path atomically: it is written to a
+// sibling tempfile and fsynced, the existing file is backed up if
+// -backup is set, then the tempfile is renamed into place.
+func writeMirrorList(path string, body []byte) error {
+	tmp := fmt.Sprintf("%s.tmp-%d", path, os.Getpid())
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(body); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if *backup {
+		if _, err := os.Stat(path); err == nil {
+			if err := os.Rename(path, path+".bak"); err != nil {
+				os.Remove(tmp)
+				return fmt.Errorf("could not back up %s: %w", path, err)
+			}
+		}
+	}
+	return os.Rename(tmp, path)
+}
+
+// fetchScrapeLinks fetches and parses the plain text mirror list at link,
+// returning the mirror base URLs found in its commented out Server lines.
+func fetchScrapeLinks(ctx context.Context, link string, client *http.Client) ([]string, error) {
+	body, err := fetchMirrorList(ctx, link, client)
+	if err != nil {
+		return nil, err
+	}
+
 	links := []string{}
 	regex := regexp.MustCompile(`#Server\s*\=\s*(.+?)\/\$repo\/os\/\$arch`)
-	scanner := bufio.NewScanner(response.Body)
+	scanner := bufio.NewScanner(bytes.NewReader(body))
 	for scanner.Scan() {
-		link := scanner.Text()
-		matches := regex.FindStringSubmatch(link)
+		matches := regex.FindStringSubmatch(scanner.Text())
 		if len(matches) < 1 {
 			continue
 		}
 		links = append(links, matches[1])
 	}
+	return links, nil
+}
+
+// fetchStatusMirrors fetches and parses the Arch mirror status JSON API at
+// link, returning a mirror for every active entry.
+func fetchStatusMirrors(ctx context.Context, link string, client *http.Client) ([]mirror, error) {
+	body, err := fetchMirrorList(ctx, link, client)
+	if err != nil {
+		return nil, err
+	}
 
-	// Create mirror HTTP client.
-	client.Timeout = *mirrorTimeout
+	status := statusResponse{}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
 
-	// Create mirrors channel.
-	length := len(links)
-	channel := make(chan *mirror, length)
+	mirrors := []mirror{}
+	for _, v := range status.URLs {
+		if !v.Active {
+			continue
+		}
+		m := mirror{
+			link:          strings.TrimSuffix(v.URL, "/"),
+			score:         v.Score,
+			completionPct: v.CompletionPct,
+			delay:         v.Delay,
+			countryCode:   v.CountryCode,
+			ipv4:          v.IPv4,
+			ipv6:          v.IPv6,
+			protocol:      v.Protocol,
+		}
+		if v.LastSync != nil {
+			if t, err := time.Parse(time.RFC3339, *v.LastSync); err == nil {
+				m.lastSync = t
+			}
+		}
+		mirrors = append(mirrors, m)
+	}
+	return mirrors, nil
+}
 
-	// Define execution beginning time.
-	begin := time.Now()
+// fetchMirrorList returns the raw body of link, from the local cache when
+// -cache-ttl is non-zero and a fresh copy exists, otherwise from the
+// network, writing it to the cache for next time.
+func fetchMirrorList(ctx context.Context, link string, client *http.Client) ([]byte, error) {
+	if *cacheTTL <= 0 {
+		return fetchRemoteMirrorList(ctx, link, client)
+	}
 
-	// Ping mirror links.
-	wait.Add(length)
-	for _, v := range links {
-		go ping(v, client, channel)
+	path, err := cachePath(link)
+	if err == nil {
+		if body, ok := readCachedMirrorList(path); ok {
+			return body, nil
+		}
 	}
-	wait.Wait()
-	close(channel)
 
-	// Define execution ending time.
-	end := time.Since(begin).Seconds()
+	body, err := fetchRemoteMirrorList(ctx, link, client)
+	if err != nil {
+		return nil, err
+	}
+	if path != "" {
+		writeCachedMirrorList(path, body)
+	}
+	return body, nil
+}
 
-	// Check if mirrors count less than requested count.
-	if len(channel) < *count {
-		erro.Print("could not get %d mirror(s)\n", *count)
+// fetchRemoteMirrorList fetches the raw body of link over HTTP.
+func fetchRemoteMirrorList(ctx context.Context, link string, client *http.Client) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, link, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	return io.ReadAll(response.Body)
+}
+
+// cachePath returns the cache file path for link, creating -cache-dir (or
+// its default) if it does not already exist.
+func cachePath(link string) (string, error) {
+	dir := *cacheDir
+	if dir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(userCacheDir, "mirrorlist")
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256([]byte(link))
+	return filepath.Join(dir, fmt.Sprintf("%x.txt", sum)), nil
+}
+
+// readCachedMirrorList reads path if it exists and is within -cache-ttl.
+func readCachedMirrorList(path string) ([]byte, bool) {
+	info, err := os.Stat(path)
+	if err != nil || time.Since(info.ModTime()) > *cacheTTL {
+		return nil, false
+	}
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, false
+	}
+	return body, true
+}
+
+// writeCachedMirrorList writes body to path atomically, via a sibling
+// tempfile followed by a rename.
+func writeCachedMirrorList(path string, body []byte) {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, body, 0644); err != nil {
 		return
 	}
+	os.Rename(tmp, path)
+}
 
-	// Sort mirrors by time.
-	mirrors := []mirror{}
-	for v := range channel {
-		mirrors = append(mirrors, *v)
+// filterByProtocol removes mirrors that do not match the -http-only or
+// -https-only flags. It only applies to mirrors fetched from the JSON
+// source, since the scrape source already splits links by protocol.
+func filterByProtocol(mirrors []mirror) []mirror {
+	if !*httpOnly && !*httpsOnly {
+		return mirrors
 	}
-	slices.SortFunc(mirrors, func(x mirror, y mirror) int {
-		return cmp.Compare(x.time, y.time)
-	})
+	filtered := []mirror{}
+	for _, v := range mirrors {
+		if *httpOnly && v.protocol != "http" {
+			continue
+		}
+		if *httpsOnly && v.protocol != "https" {
+			continue
+		}
+		filtered = append(filtered, v)
+	}
+	return filtered
+}
 
-	// Get output.
-	writer := os.Stdout
-	if *output != "" {
-		file, err := os.OpenFile(*output, os.O_CREATE|os.O_WRONLY, 0644)
-		if err != nil {
-			erro.Print("could not create %s\n", *output)
-			return
+// metadataFiltersUsed reports whether any flag that depends on Arch mirror
+// status JSON metadata was set, which only -source=json populates.
+func metadataFiltersUsed() bool {
+	return *countries != "" || *maxAge > 0 || *maxDelay > 0 || *minCompletion > 0 || *maxScore > 0 || *ipv4Only || *ipv6Only
+}
+
+// filterMirrors removes mirrors that do not satisfy the -countries,
+// -max-age, -max-delay, -min-completion, -max-score, -ipv4, and -ipv6 flags.
+func filterMirrors(mirrors []mirror) []mirror {
+	var countryCodes []string
+	if *countries != "" {
+		for _, v := range strings.Split(*countries, ",") {
+			countryCodes = append(countryCodes, strings.ToUpper(strings.TrimSpace(v)))
 		}
-		defer file.Close()
-		writer = file
 	}
-	for _, v := range mirrors[:*count] {
-		fmt.Fprintf(writer, "# %f\n", v.time)
-		fmt.Fprintf(writer, "Server = %s/$repo/os/$arch\n", v.link)
+
+	filtered := []mirror{}
+	for _, v := range mirrors {
+		if len(countryCodes) > 0 && !slices.Contains(countryCodes, strings.ToUpper(v.countryCode)) {
+			continue
+		}
+		if *maxAge > 0 && !v.lastSync.IsZero() && time.Since(v.lastSync).Hours() > *maxAge {
+			continue
+		}
+		if *maxDelay > 0 && v.delay > *maxDelay {
+			continue
+		}
+		if *minCompletion > 0 && v.completionPct < *minCompletion {
+			continue
+		}
+		if *maxScore > 0 && v.score > *maxScore {
+			continue
+		}
+		if *ipv4Only && !v.ipv4 {
+			continue
+		}
+		if *ipv6Only && !v.ipv6 {
+			continue
+		}
+		filtered = append(filtered, v)
 	}
-	fmt.Fprintf(writer, "# Generated by github.com/enindu/mirrorlist\n")
+	return filtered
+}
 
-	// Print information messages.
-	info.Print("mirror list is generated\n")
-	info.Print("executed in %.2f seconds\n", end)
+// sortFunc returns the comparison function used to rank mirrors for the
+// given -sort value.
+func sortFunc(key string) func(x mirror, y mirror) int {
+	switch key {
+	case "score":
+		return func(x mirror, y mirror) int {
+			return cmp.Compare(x.score, y.score)
+		}
+	case "age":
+		return func(x mirror, y mirror) int {
+			return cmp.Compare(y.lastSync.Unix(), x.lastSync.Unix())
+		}
+	case "delay":
+		return func(x mirror, y mirror) int {
+			return cmp.Compare(x.delay, y.delay)
+		}
+	case "country":
+		return func(x mirror, y mirror) int {
+			return cmp.Compare(x.countryCode, y.countryCode)
+		}
+	default:
+		if *rate {
+			return func(x mirror, y mirror) int {
+				return cmp.Compare(y.rate, x.rate)
+			}
+		}
+		return func(x mirror, y mirror) int {
+			return cmp.Compare(x.time, y.time)
+		}
+	}
 }
 
-func ping(l string, c *http.Client, m chan *mirror) {
-	// Defer wait done.
-	defer wait.Done()
+func ping(ctx context.Context, m mirror, c *http.Client) (mirror, bool) {
+	url := m.link
+	if *rate {
+		url = m.link + "/" + *rateURLPath
+	}
 
 	// Ping mirror link.
 	end := time.Duration(0)
+	bytes := int64(0)
 	for i := 0; i < *pings; i++ {
 		begin := time.Now()
-		response, err := c.Get(l)
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return mirror{}, false
+		}
+		response, err := c.Do(request)
 		if err != nil {
 			if *verbose {
-				warn.Print("could not get response from %s\n", l)
+				warn.Print("could not get response from %s\n", url)
 			}
-			return
+			return mirror{}, false
+		}
+		if *rate {
+			n, err := io.Copy(io.Discard, io.LimitReader(response.Body, *rateBytes))
+			response.Body.Close()
+			if err != nil {
+				if *verbose {
+					warn.Print("could not download %s\n", url)
+				}
+				return mirror{}, false
+			}
+			bytes += n
+		} else {
+			response.Body.Close()
 		}
-		defer response.Body.Close()
 		if response.StatusCode != http.StatusOK {
 			if *verbose {
-				warn.Print("got %d status code from %s\n", response.StatusCode, l)
+				warn.Print("got %d status code from %s\n", response.StatusCode, url)
 			}
-			return
+			return mirror{}, false
 		}
 		end = end + time.Since(begin)
 	}
 	if end <= 0 {
 		if *verbose {
-			warn.Print("%s is not responding\n", l)
+			warn.Print("%s is not responding\n", url)
 		}
-		return
+		return mirror{}, false
 	}
 
-	// Send mirror to mirrors channel.
-	m <- &mirror{
-		link: l,
-		time: end.Seconds() / float64(*pings),
+	// Report the probed mirror back to the pool.
+	m.time = end.Seconds() / float64(*pings)
+	if *rate {
+		m.rate = float64(bytes) / 1024 / end.Seconds()
 	}
+	return m, true
 }
@@ -0,0 +1,440 @@
+// This file is part of Mirrorlist.
+// Copyright (C) 2024 Enindu Alahapperuma
+//
+// Mirrorlist is free software: you can redistribute it and/or modify it under
+// the terms of the GNU General Public License as published by the Free Software
+// Foundation, either version 3 of the License, or (at your option) any later
+// version.
+//
+// Mirrorlist is distributed in the hope that it will be useful, but WITHOUT ANY
+// WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS FOR
+// A PARTICULAR PURPOSE. See the GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along with
+// Mirrorlist. If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFilterByProtocol(t *testing.T) {
+	mirrors := []mirror{
+		{link: "https://a", protocol: "https"},
+		{link: "http://b", protocol: "http"},
+	}
+
+	cases := []struct {
+		name      string
+		httpOnly  bool
+		httpsOnly bool
+		want      []string
+	}{
+		{"neither flag", false, false, []string{"https://a", "http://b"}},
+		{"http only", true, false, []string{"http://b"}},
+		{"https only", false, true, []string{"https://a"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			*httpOnly, *httpsOnly = c.httpOnly, c.httpsOnly
+			t.Cleanup(func() { *httpOnly, *httpsOnly = false, false })
+
+			got := filterByProtocol(mirrors)
+			if len(got) != len(c.want) {
+				t.Fatalf("got %d mirrors, want %d", len(got), len(c.want))
+			}
+			for i, v := range got {
+				if v.link != c.want[i] {
+					t.Errorf("mirror %d: got %s, want %s", i, v.link, c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFilterMirrors(t *testing.T) {
+	now := time.Now()
+	mirrors := []mirror{
+		{link: "a", countryCode: "US", lastSync: now, delay: 10, completionPct: 1, score: 1, ipv4: true},
+		{link: "b", countryCode: "DE", lastSync: now.Add(-48 * time.Hour), delay: 7200, completionPct: 0.5, score: 50, ipv6: true},
+	}
+
+	cases := []struct {
+		name   string
+		modify func()
+		want   []string
+	}{
+		{"no filters", func() {}, []string{"a", "b"}},
+		{"countries", func() { *countries = "us" }, []string{"a"}},
+		{"max age", func() { *maxAge = 1 }, []string{"a"}},
+		{"max delay", func() { *maxDelay = 60 }, []string{"a"}},
+		{"min completion", func() { *minCompletion = 0.9 }, []string{"a"}},
+		{"max score", func() { *maxScore = 10 }, []string{"a"}},
+		{"ipv4 only", func() { *ipv4Only = true }, []string{"a"}},
+		{"ipv6 only", func() { *ipv6Only = true }, []string{"b"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.modify()
+			t.Cleanup(func() {
+				*countries, *maxAge, *maxDelay, *minCompletion, *maxScore, *ipv4Only, *ipv6Only = "", 0, 0, 0, 0, false, false
+			})
+
+			got := filterMirrors(mirrors)
+			if len(got) != len(c.want) {
+				t.Fatalf("got %d mirrors, want %d", len(got), len(c.want))
+			}
+			for i, v := range got {
+				if v.link != c.want[i] {
+					t.Errorf("mirror %d: got %s, want %s", i, v.link, c.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestSortFuncRateMode(t *testing.T) {
+	*rate = true
+	t.Cleanup(func() { *rate = false })
+
+	mirrors := []mirror{
+		{link: "slow", rate: 10},
+		{link: "fast", rate: 100},
+	}
+	less := sortFunc("rate")
+	if less(mirrors[0], mirrors[1]) <= 0 {
+		t.Fatal("expected the faster mirror to sort first when -rate is set")
+	}
+}
+
+func TestPingRateMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("0123456789"))
+	}))
+	defer server.Close()
+
+	*rate = true
+	originalPings := *pings
+	*pings = 1
+	t.Cleanup(func() {
+		*rate = false
+		*pings = originalPings
+	})
+
+	got, ok := ping(context.Background(), mirror{link: server.URL}, server.Client())
+	if !ok {
+		t.Fatal("expected ping to succeed")
+	}
+	if got.rate <= 0 {
+		t.Errorf("expected a measured rate, got %f", got.rate)
+	}
+}
+
+func TestCachePath(t *testing.T) {
+	dir := t.TempDir()
+	*cacheDir = dir
+	t.Cleanup(func() { *cacheDir = "" })
+
+	path1, err := cachePath("https://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path2, err := cachePath("https://a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path1 != path2 {
+		t.Errorf("cachePath is not deterministic: %s != %s", path1, path2)
+	}
+
+	path3, err := cachePath("https://b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if path1 == path3 {
+		t.Errorf("different links produced the same cache path: %s", path1)
+	}
+
+	if filepath.Dir(path1) != dir {
+		t.Errorf("cache path %s is not inside -cache-dir %s", path1, dir)
+	}
+}
+
+func TestWriteAndReadCachedMirrorList(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.txt")
+	writeCachedMirrorList(path, []byte("hello"))
+
+	originalTTL := *cacheTTL
+	*cacheTTL = time.Hour
+	t.Cleanup(func() { *cacheTTL = originalTTL })
+
+	body, ok := readCachedMirrorList(path)
+	if !ok {
+		t.Fatal("expected a fresh cache entry to be read")
+	}
+	if string(body) != "hello" {
+		t.Errorf("got %q, want %q", body, "hello")
+	}
+}
+
+func TestReadCachedMirrorListExpired(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.txt")
+	writeCachedMirrorList(path, []byte("hello"))
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	originalTTL := *cacheTTL
+	*cacheTTL = time.Minute
+	t.Cleanup(func() { *cacheTTL = originalTTL })
+
+	if _, ok := readCachedMirrorList(path); ok {
+		t.Fatal("expected an expired cache entry to be ignored")
+	}
+}
+
+func TestReadCachedMirrorListMissing(t *testing.T) {
+	if _, ok := readCachedMirrorList(filepath.Join(t.TempDir(), "missing.txt")); ok {
+		t.Fatal("expected a missing cache entry to report a miss")
+	}
+}
+
+func TestFetchMirrorListUsesCache(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.Write([]byte("mirror list"))
+	}))
+	defer server.Close()
+
+	originalCacheDir, originalTTL := *cacheDir, *cacheTTL
+	*cacheDir = t.TempDir()
+	*cacheTTL = time.Hour
+	t.Cleanup(func() {
+		*cacheDir = originalCacheDir
+		*cacheTTL = originalTTL
+	})
+
+	for i := 0; i < 2; i++ {
+		body, err := fetchMirrorList(context.Background(), server.URL, server.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != "mirror list" {
+			t.Errorf("got %q, want %q", body, "mirror list")
+		}
+	}
+
+	if requests != 1 {
+		t.Errorf("got %d requests, want 1 (second fetch should hit the cache)", requests)
+	}
+}
+
+func TestRenderMirrorList(t *testing.T) {
+	mirrors := []mirror{
+		{link: "https://a", time: 0.123456, countryCode: "US", rate: 50},
+	}
+	body := renderMirrorList([]string{"Server = https://pinned/archlinux"}, mirrors)
+
+	want := "Server = https://pinned/archlinux\n" +
+		generatedMarker + "\n" +
+		"# country: US\n" +
+		"# rate: 50.00 KiB/s\n" +
+		"# 0.123456\n" +
+		"Server = https://a/$repo/os/$arch\n"
+	if string(body) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", body, want)
+	}
+}
+
+func TestReadPinnedServerLinesNewFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.txt")
+	content := "Server = https://pinned/archlinux\n" +
+		generatedMarker + "\n" +
+		"# 0.100000\n" +
+		"Server = https://a/$repo/os/$arch\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readPinnedServerLines(path)
+	want := []string{"Server = https://pinned/archlinux"}
+	if len(got) != len(want) || got[0] != want[0] {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReadPinnedServerLinesLegacyFormat(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.txt")
+	content := "# 0.100000\n" +
+		"Server = https://a/$repo/os/$arch\n" +
+		generatedMarker + "\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	got := readPinnedServerLines(path)
+	if len(got) != 0 {
+		t.Errorf("expected a pre-merge (legacy) file to have nothing pinned, got %v", got)
+	}
+}
+
+func TestReadPinnedServerLinesMissing(t *testing.T) {
+	got := readPinnedServerLines(filepath.Join(t.TempDir(), "missing.txt"))
+	if got != nil {
+		t.Errorf("expected a missing file to report no pinned lines, got %v", got)
+	}
+}
+
+func TestWriteMirrorListBacksUpExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.txt")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*backup = true
+	t.Cleanup(func() { *backup = false })
+
+	if err := writeMirrorList(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "new" {
+		t.Errorf("got %q, want %q", got, "new")
+	}
+
+	backupContent, err := os.ReadFile(path + ".bak")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(backupContent) != "old" {
+		t.Errorf("got %q, want %q", backupContent, "old")
+	}
+}
+
+func TestWriteMirrorListNoBackupByDefault(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.txt")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeMirrorList(path, []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(path + ".bak"); !os.IsNotExist(err) {
+		t.Errorf("expected no .bak file without -backup, stat error: %v", err)
+	}
+}
+
+func TestWriteMirrorListBackupFailureAborts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mirrors.txt")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// Make the backup destination an existing non-empty directory, so the
+	// rename that writeMirrorList attempts for the backup fails.
+	backupDir := path + ".bak"
+	if err := os.Mkdir(backupDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(backupDir, "keep"), []byte("x"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	*backup = true
+	t.Cleanup(func() { *backup = false })
+
+	if err := writeMirrorList(path, []byte("new")); err == nil {
+		t.Fatal("expected writeMirrorList to fail when the backup rename fails")
+	}
+
+	got, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "old" {
+		t.Errorf("original file was clobbered despite the failed backup: got %q", got)
+	}
+}
+
+func TestPingCancelledContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, ok := ping(ctx, mirror{link: server.URL}, server.Client())
+	if ok {
+		t.Fatal("expected ping to fail against an already-cancelled context")
+	}
+}
+
+func TestMetadataFiltersUsed(t *testing.T) {
+	t.Cleanup(func() {
+		*countries, *maxAge, *maxDelay, *minCompletion, *maxScore, *ipv4Only, *ipv6Only = "", 0, 0, 0, 0, false, false
+	})
+
+	if metadataFiltersUsed() {
+		t.Fatal("expected no metadata filters to be in use by default")
+	}
+	*countries = "US"
+	if !metadataFiltersUsed() {
+		t.Fatal("expected -countries to count as a metadata filter")
+	}
+}
+
+func TestSortFunc(t *testing.T) {
+	mirrors := []mirror{
+		{link: "a", time: 2, score: 10, delay: 5, countryCode: "US", lastSync: time.Unix(200, 0)},
+		{link: "b", time: 1, score: 5, delay: 10, countryCode: "DE", lastSync: time.Unix(100, 0)},
+	}
+
+	cases := []struct {
+		key  string
+		want string
+	}{
+		{"rate", "b"},
+		{"score", "b"},
+		{"age", "a"},
+		{"delay", "a"},
+		{"country", "DE"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.key, func(t *testing.T) {
+			sorted := append([]mirror{}, mirrors...)
+			less := sortFunc(c.key)
+			if less(sorted[0], sorted[1]) > 0 {
+				sorted[0], sorted[1] = sorted[1], sorted[0]
+			}
+			got := sorted[0].link
+			if c.key == "country" {
+				got = sorted[0].countryCode
+			}
+			if got != c.want {
+				t.Errorf("sortFunc(%q): got %s first, want %s", c.key, got, c.want)
+			}
+		})
+	}
+}